@@ -2,11 +2,14 @@ package server
 
 import (
 	"context"
+	"database/sql"
+	"strings"
 	"sync"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/pachyderm/pachyderm/src/client/pfs"
 	"github.com/pachyderm/pachyderm/src/client/pkg/errors"
+	"github.com/pachyderm/pachyderm/src/server/pkg/log"
 	"github.com/pachyderm/pachyderm/src/server/pkg/storage/fileset"
 	"github.com/pachyderm/pachyderm/src/server/pkg/storage/track"
 )
@@ -19,12 +22,39 @@ type commitStore interface {
 	// Deleter() track.Deleter
 }
 
+// diffHash fingerprints an ordered list of diff fileset IDs so a memoized
+// Compose total can be invalidated exactly when the staging list it was
+// computed from changes.
+func diffHash(ids []fileset.ID) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = string(id)
+	}
+	return strings.Join(strs, ",")
+}
+
+// memFilesetRef tracks, for one commit, the clone staged for a given source
+// fileset.ID and how many times AddFileset has been asked to stage it.
+type memFilesetRef struct {
+	diffID   fileset.ID
+	refcount int
+}
+
+// memDiffTotal memoizes the result of composing a commit's staging list, so
+// repeated GetFileset calls between AddFilesets don't re-run Compose.
+type memDiffTotal struct {
+	diffHash string
+	id       fileset.ID
+}
+
 type memCommitStore struct {
 	s *fileset.Storage
 
 	mu       sync.Mutex
 	staging  map[string][]fileset.ID
 	finished map[string]fileset.ID
+	refs     map[string]map[fileset.ID]*memFilesetRef
+	totals   map[string]memDiffTotal
 }
 
 func newMemCommitStore(s *fileset.Storage) *memCommitStore {
@@ -32,6 +62,8 @@ func newMemCommitStore(s *fileset.Storage) *memCommitStore {
 		s:        s,
 		staging:  make(map[string][]fileset.ID),
 		finished: make(map[string]fileset.ID),
+		refs:     make(map[string]map[fileset.ID]*memFilesetRef),
+		totals:   make(map[string]memDiffTotal),
 	}
 }
 
@@ -42,13 +74,30 @@ func (s *memCommitStore) AddFileset(ctx context.Context, commit *pfs.Commit, fil
 	if _, exists := s.finished[key]; exists {
 		return errors.Errorf("commit is finished")
 	}
+	if ref, ok := s.refs[key][filesetID]; ok {
+		// This exact chunk set has already been staged for this commit
+		// (common when many workers emit the same datum output); share the
+		// existing clone instead of making another one.
+		ref.refcount++
+		return nil
+	}
 	id, err := s.s.Clone(ctx, filesetID, track.NoTTL)
 	if err != nil {
 		return err
 	}
-	ids := s.staging[key]
-	ids = append(ids, *id)
-	s.staging[key] = ids
+	s.staging[key] = append(s.staging[key], *id)
+	if s.refs[key] == nil {
+		s.refs[key] = make(map[fileset.ID]*memFilesetRef)
+	}
+	s.refs[key][filesetID] = &memFilesetRef{diffID: *id, refcount: 1}
+	if total, ok := s.totals[key]; ok {
+		// The staging list just changed, so the memoized total is stale;
+		// drop the NoTTL fileset it points to instead of leaking it.
+		if err := s.s.Drop(ctx, total.id); err != nil {
+			return err
+		}
+		delete(s.totals, key)
+	}
 	return nil
 }
 
@@ -59,8 +108,17 @@ func (s *memCommitStore) GetFileset(ctx context.Context, commit *pfs.Commit) (*f
 	if id, exists := s.finished[key]; exists {
 		return s.s.Clone(ctx, id, defaultTTL)
 	}
-	// return nil, errors.Errorf("commit is not finished")
-	return s.s.Compose(ctx, s.staging[key], defaultTTL)
+	ids := s.staging[key]
+	hash := diffHash(ids)
+	if cached, ok := s.totals[key]; ok && cached.diffHash == hash {
+		return s.s.Clone(ctx, cached.id, defaultTTL)
+	}
+	id, err := s.s.Compose(ctx, ids, track.NoTTL)
+	if err != nil {
+		return nil, err
+	}
+	s.totals[key] = memDiffTotal{diffHash: hash, id: *id}
+	return s.s.Clone(ctx, *id, defaultTTL)
 }
 
 func (s *memCommitStore) UpdateFileset(ctx context.Context, commit *pfs.Commit, fn func(fileset.ID) (*fileset.ID, error)) error {
@@ -91,8 +149,15 @@ func (s *memCommitStore) DropFilesets(ctx context.Context, commit *pfs.Commit) e
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	key := commitKey(commit)
+	if total, ok := s.totals[key]; ok {
+		if err := s.s.Drop(ctx, total.id); err != nil {
+			return err
+		}
+	}
+	delete(s.totals, key)
 	delete(s.finished, key)
 	delete(s.staging, key)
+	delete(s.refs, key)
 	return nil
 }
 
@@ -112,24 +177,72 @@ func newPostgresCommitStore(db *sqlx.DB, tr track.Tracker, s *fileset.Storage) *
 	}
 }
 
-func (cs *postgresCommitStore) AddFileset(ctx context.Context, commit *pfs.Commit, id fileset.ID) error {
-	// clone to remove the ttl.
+func (cs *postgresCommitStore) AddFileset(ctx context.Context, commit *pfs.Commit, id fileset.ID) (retErr error) {
+	defer func() { log.LogIf(ctx, retErr, "commit", commit.ID) }()
+
+	// clone to remove the ttl. If it turns out commit already has a ref on
+	// id (below), this clone goes unused and is dropped immediately.
 	id2, err := cs.s.Clone(ctx, id, track.NoTTL)
 	if err != nil {
 		return err
 	}
-	var num int
-	if err := cs.db.GetContext(ctx, &num,
+
+	// The refcount bump and the insert-if-absent must happen atomically, or
+	// two concurrent AddFilesets staging the same fileset_id for the same
+	// commit (common when many workers emit the same datum output) can both
+	// see no existing row and race to insert, with the loser hitting a
+	// primary-key violation instead of being deduped. "xmax = 0" is true iff
+	// this statement inserted the row rather than hitting the DO UPDATE arm.
+	var inserted bool
+	if err := cs.db.GetContext(ctx, &inserted,
+		`INSERT INTO pfs.commit_fileset_refs (repo_name, commit_id, fileset_id, diff_id, refcount)
+		VALUES ($1, $2, $3, $4, 1)
+		ON CONFLICT (repo_name, commit_id, fileset_id) DO UPDATE
+		SET refcount = commit_fileset_refs.refcount + 1
+		RETURNING (xmax = 0)
+	`, commit.Repo.Name, commit.ID, id, *id2); err != nil {
+		return err
+	}
+	if !inserted {
+		// Shared the existing clone instead; the one made above is unused.
+		return cs.s.Drop(ctx, *id2)
+	}
+
+	_, err = cs.db.ExecContext(ctx,
 		`INSERT INTO pfs.commit_diffs (repo_name, commit_id, fileset_id)
 		VALUES ($1, $2, $3)
-		RETURNING num
-	`, commit.Repo.Name, commit.ID, *id2); err != nil {
+	`, commit.Repo.Name, commit.ID, *id2)
+	return err
+}
+
+// releaseFilesetRef releases n references commit holds on the diff cloned
+// from filesetID, dropping the underlying fileset and its ref row once the
+// count reaches zero instead of leaving it dangling.
+func (cs *postgresCommitStore) releaseFilesetRef(ctx context.Context, commit *pfs.Commit, filesetID fileset.ID, n int) error {
+	var remaining int
+	if err := cs.db.GetContext(ctx, &remaining,
+		`UPDATE pfs.commit_fileset_refs SET refcount = refcount - $4
+		WHERE repo_name = $1 AND commit_id = $2 AND fileset_id = $3
+		RETURNING refcount
+	`, commit.Repo.Name, commit.ID, filesetID, n); err != nil {
 		return err
 	}
-	return nil
+	if remaining > 0 {
+		return nil
+	}
+	var diffID fileset.ID
+	if err := cs.db.GetContext(ctx, &diffID,
+		`DELETE FROM pfs.commit_fileset_refs
+		WHERE repo_name = $1 AND commit_id = $2 AND fileset_id = $3
+		RETURNING diff_id
+	`, commit.Repo.Name, commit.ID, filesetID); err != nil {
+		return err
+	}
+	return cs.s.Drop(ctx, diffID)
 }
 
-func (cs *postgresCommitStore) GetFileset(ctx context.Context, commit *pfs.Commit) (*fileset.ID, error) {
+func (cs *postgresCommitStore) GetFileset(ctx context.Context, commit *pfs.Commit) (filesetID *fileset.ID, retErr error) {
+	defer func() { log.LogIf(ctx, retErr, "commit", commit.ID) }()
 	id, err := cs.getTotal(ctx, commit)
 	if err == nil {
 		return cs.s.Clone(ctx, *id, defaultTTL)
@@ -138,10 +251,95 @@ func (cs *postgresCommitStore) GetFileset(ctx context.Context, commit *pfs.Commi
 	if err != nil {
 		return nil, err
 	}
-	return cs.s.Compose(ctx, ids, defaultTTL)
+	if cached, ok, err := cs.getDiffTotal(ctx, commit, ids); err != nil {
+		return nil, err
+	} else if ok {
+		return cs.s.Clone(ctx, cached, defaultTTL)
+	}
+	composed, err := cs.s.Compose(ctx, ids, track.NoTTL)
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.setDiffTotal(ctx, commit, ids, *composed); err != nil {
+		return nil, err
+	}
+	return cs.s.Clone(ctx, *composed, defaultTTL)
+}
+
+// getDiffTotal returns the memoized Compose result for commit's current
+// staging list ids, if one is cached and the list hasn't changed since.
+func (cs *postgresCommitStore) getDiffTotal(ctx context.Context, commit *pfs.Commit, ids []fileset.ID) (fileset.ID, bool, error) {
+	var row struct {
+		DiffHash  string     `db:"diff_hash"`
+		FilesetID fileset.ID `db:"fileset_id"`
+	}
+	err := cs.db.GetContext(ctx, &row,
+		`SELECT diff_hash, fileset_id FROM pfs.commit_diff_totals
+		WHERE repo_name = $1 AND commit_id = $2
+	`, commit.Repo.Name, commit.ID)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if row.DiffHash != diffHash(ids) {
+		// The staging list has grown since this total was memoized.
+		return "", false, nil
+	}
+	return row.FilesetID, true, nil
+}
+
+func (cs *postgresCommitStore) setDiffTotal(ctx context.Context, commit *pfs.Commit, ids []fileset.ID, total fileset.ID) error {
+	// old locks the existing row (if any) and captures its fileset_id in the
+	// same statement as the upsert that replaces it, so a concurrent caller
+	// computing the same commit's diff total can't read the same old row and
+	// race to overwrite it -- the two would serialize on old's row lock
+	// instead. The replaced fileset_id (if any) points at a NoTTL fileset
+	// that's about to become unreachable, so it's dropped below instead of
+	// leaking for the life of the commit.
+	var old sql.NullString
+	if err := cs.db.GetContext(ctx, &old,
+		`WITH old AS (
+			SELECT fileset_id FROM pfs.commit_diff_totals
+			WHERE repo_name = $1 AND commit_id = $2
+			FOR UPDATE
+		)
+		INSERT INTO pfs.commit_diff_totals (repo_name, commit_id, diff_hash, fileset_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (repo_name, commit_id) DO UPDATE
+		SET diff_hash = $3, fileset_id = $4
+		RETURNING (SELECT fileset_id FROM old)
+	`, commit.Repo.Name, commit.ID, diffHash(ids), total); err != nil {
+		return err
+	}
+
+	if old.Valid {
+		return cs.s.Drop(ctx, fileset.ID(old.String))
+	}
+	return nil
+}
+
+// dropDiffTotal removes commit's memoized diff total, if any, and frees the
+// fileset it points to.
+func (cs *postgresCommitStore) dropDiffTotal(ctx context.Context, commit *pfs.Commit) error {
+	var id fileset.ID
+	err := cs.db.GetContext(ctx, &id,
+		`DELETE FROM pfs.commit_diff_totals
+		WHERE repo_name = $1 AND commit_id = $2
+		RETURNING fileset_id
+	`, commit.Repo.Name, commit.ID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return cs.s.Drop(ctx, id)
 }
 
-func (cs *postgresCommitStore) SetFileset(ctx context.Context, commit *pfs.Commit, id fileset.ID) error {
+func (cs *postgresCommitStore) SetFileset(ctx context.Context, commit *pfs.Commit, id fileset.ID) (retErr error) {
+	defer func() { log.LogIf(ctx, retErr, "commit", commit.ID) }()
 	_, err := cs.db.ExecContext(ctx,
 		`INSERT INTO pfs.commit_totals (repo_name, commit_id, fileset_id)
 		VALUES ($1, $2, $3)
@@ -152,18 +350,31 @@ func (cs *postgresCommitStore) SetFileset(ctx context.Context, commit *pfs.Commi
 	return err
 }
 
-func (cs *postgresCommitStore) DropFilesets(ctx context.Context, commit *pfs.Commit) error {
-	// TODO: do something about the potential dangling references
-	diffIDs, err := cs.getDiff(ctx, commit)
-	if err != nil {
+func (cs *postgresCommitStore) DropFilesets(ctx context.Context, commit *pfs.Commit) (retErr error) {
+	defer func() { log.LogIf(ctx, retErr, "commit", commit.ID) }()
+	if err := cs.dropDiffTotal(ctx, commit); err != nil {
+		return err
+	}
+
+	var refs []struct {
+		FilesetID fileset.ID `db:"fileset_id"`
+		Refcount  int        `db:"refcount"`
+	}
+	if err := cs.db.SelectContext(ctx, &refs,
+		`SELECT fileset_id, refcount FROM pfs.commit_fileset_refs
+		WHERE repo_name = $1 AND commit_id = $2
+	`, commit.Repo.Name, commit.ID); err != nil {
 		return err
 	}
-	for _, id := range diffIDs {
-		if err := cs.s.Drop(ctx, id); err != nil {
+	for _, ref := range refs {
+		// The commit is going away entirely, so every caller holding a
+		// reference to this fileset is releasing it at once; this brings the
+		// count to zero and frees the fileset instead of leaving it dangling.
+		if err := cs.releaseFilesetRef(ctx, commit, ref.FilesetID, ref.Refcount); err != nil {
 			return err
 		}
 	}
-	if _, err := cs.db.ExecContext(ctx, `DELETE FROM pfs.commit_diffs WHERE repo_name = $1 AND commit_id = $2`); err != nil {
+	if _, err := cs.db.ExecContext(ctx, `DELETE FROM pfs.commit_diffs WHERE repo_name = $1 AND commit_id = $2`, commit.Repo.Name, commit.ID); err != nil {
 		return err
 	}
 	id, err := cs.getTotal(ctx, commit)
@@ -173,7 +384,7 @@ func (cs *postgresCommitStore) DropFilesets(ctx context.Context, commit *pfs.Com
 	if err := cs.s.Drop(ctx, *id); err != nil {
 		return err
 	}
-	if _, err := cs.db.ExecContext(ctx, `DELETE FROM pfs.commit_totals WHERE repo_name = $1 AND commit_id = $2`); err != nil {
+	if _, err := cs.db.ExecContext(ctx, `DELETE FROM pfs.commit_totals WHERE repo_name = $1 AND commit_id = $2`, commit.Repo.Name, commit.ID); err != nil {
 		return err
 	}
 	return nil
@@ -224,6 +435,28 @@ func SetupPostgresCommitStoreV0(ctx context.Context, tx *sqlx.Tx) error {
 			fileset_id VARCHAR(64) NOT NULL,
 			PRIMARY KEY(repo, commit_id)
 		);
+
+		-- commit_fileset_refs dedups AddFileset: a fileset_id staged more than
+		-- once for the same commit bumps refcount instead of cloning another
+		-- copy, and DropFilesets only frees diff_id once refcount reaches 0.
+		CREATE TABLE pfs.commit_fileset_refs (
+			repo_name VARCHAR(250) NOT NULL,
+			commit_id VARCHAR(64) NOT NULL,
+			fileset_id VARCHAR(64) NOT NULL,
+			diff_id VARCHAR(64) NOT NULL,
+			refcount INT NOT NULL DEFAULT 1,
+			PRIMARY KEY(repo_name, commit_id, fileset_id)
+		);
+
+		-- commit_diff_totals memoizes Compose(staging list) for a commit until
+		-- the staging list (identified by diff_hash) changes.
+		CREATE TABLE pfs.commit_diff_totals (
+			repo_name VARCHAR(250) NOT NULL,
+			commit_id VARCHAR(64) NOT NULL,
+			diff_hash VARCHAR(8000) NOT NULL,
+			fileset_id VARCHAR(64) NOT NULL,
+			PRIMARY KEY(repo_name, commit_id)
+		);
 	`)
 	return err
 }
@@ -1,124 +1,262 @@
 package obj
 
 import (
+	"bytes"
 	"context"
-	"fmt"
 	"io"
-	"os"
+	"sort"
+	"sync"
 
 	"github.com/pachyderm/pachyderm/src/client/pkg/tracing"
+	"github.com/pachyderm/pachyderm/src/server/pkg/log"
 
-	minio "github.com/minio/minio-go/v6"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	// defaultPartSize is the size of each part in a multipart upload, used
+	// unless a caller overrides it with newMinioClient's partSize argument.
+	defaultPartSize = 16 * 1024 * 1024
+	// defaultConcurrency is how many parts newMinioWriter uploads at once,
+	// used unless a caller overrides it with newMinioClient's concurrency
+	// argument.
+	defaultConcurrency = 4
 )
 
 // Represents minio client instance for any s3 compatible server.
 type minioClient struct {
 	*minio.Client
-	bucket string
+	core        *minio.Core
+	bucket      string
+	partSize    uint64
+	concurrency int
 }
 
 // Creates a new minioClient structure and returns
-func newMinioClient(endpoint, bucket, id, secret string, secure bool) (*minioClient, error) {
-	mclient, err := minio.New(endpoint, id, secret, secure)
+func newMinioClient(endpoint, bucket, id, secret string, secure bool, partSize uint64, concurrency int) (*minioClient, error) {
+	creds := credentials.NewStaticV4(id, secret, "")
+	return newMinioClientWithCreds(endpoint, bucket, secure, partSize, concurrency, creds)
+}
+
+// Creates a new minioClient S3V2 structure and returns
+func newMinioClientV2(endpoint, bucket, id, secret string, secure bool, partSize uint64, concurrency int) (*minioClient, error) {
+	creds := credentials.NewStaticV2(id, secret, "")
+	return newMinioClientWithCreds(endpoint, bucket, secure, partSize, concurrency, creds)
+}
+
+func newMinioClientWithCreds(endpoint, bucket string, secure bool, partSize uint64, concurrency int, creds *credentials.Credentials) (*minioClient, error) {
+	opts := &minio.Options{Creds: creds, Secure: secure}
+	mclient, err := minio.New(endpoint, opts)
 	if err != nil {
 		return nil, err
 	}
-	c := &minioClient{
-		bucket: bucket,
-		Client: mclient,
+	core, err := minio.NewCore(endpoint, opts)
+	if err != nil {
+		return nil, err
 	}
-	c.TraceOn(os.Stdout)
-	return c, nil
+	if partSize == 0 {
+		partSize = defaultPartSize
+	}
+	if concurrency == 0 {
+		concurrency = defaultConcurrency
+	}
+	return &minioClient{
+		Client:      mclient,
+		core:        core,
+		bucket:      bucket,
+		partSize:    partSize,
+		concurrency: concurrency,
+	}, nil
 }
 
-// Creates a new minioClient S3V2 structure and returns
-func newMinioClientV2(endpoint, bucket, id, secret string, secure bool) (*minioClient, error) {
-	mclient, err := minio.NewV2(endpoint, id, secret, secure)
-	if err != nil {
-		return nil, err
+// partBufPool recycles the part-sized buffers used by minioWriter for the
+// common case of a writer using defaultPartSize; writers configured with a
+// different part size allocate directly instead of sharing the pool.
+var partBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, defaultPartSize)
+		return &buf
+	},
+}
+
+func getPartBuf(partSize uint64) *[]byte {
+	if partSize == defaultPartSize {
+		return partBufPool.Get().(*[]byte)
 	}
-	c := &minioClient{
-		bucket: bucket,
-		Client: mclient,
+	buf := make([]byte, partSize)
+	return &buf
+}
+
+func putPartBuf(partSize uint64, buf *[]byte) {
+	if partSize == defaultPartSize {
+		partBufPool.Put(buf)
 	}
-	c.TraceOn(os.Stdout)
-	return c, nil
 }
 
-// Represents minio writer structure with pipe and the error channel
+// minioWriter uploads to a minio object as a multipart upload: writes are
+// buffered into part-sized chunks and up to client.concurrency of them are
+// in flight via Core().PutObjectPart at any time. Close blocks until every
+// part has been uploaded, then completes the upload.
 type minioWriter struct {
-	ctx     context.Context
-	errChan chan error
-	pipe    *io.PipeWriter
+	ctx      context.Context
+	client   *minioClient
+	name     string
+	uploadID string
+
+	curBuf  *[]byte
+	cur     []byte
+	partNum int
+
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu    sync.Mutex
+	parts []minio.CompletePart
+	err   error
 }
 
-// Creates a new minio writer and a go routine to upload objects to minio server
-func newMinioWriter(ctx context.Context, client *minioClient, name string) *minioWriter {
-	reader, writer := io.Pipe()
-	w := &minioWriter{
-		ctx:     ctx,
-		errChan: make(chan error),
-		pipe:    writer,
+// Creates a new minio writer, opening a multipart upload on the minio
+// server.
+func newMinioWriter(ctx context.Context, client *minioClient, name string) (*minioWriter, error) {
+	uploadID, err := client.core.NewMultipartUpload(ctx, client.bucket, name, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return nil, err
 	}
-	go func() {
-		opts := minio.PutObjectOptions{
-			ContentType: "application/octet-stream",
-			PartSize:    uint64(8 * 1024 * 1024),
-		}
-		fmt.Printf("newMinioWriter goroutine 1 with bucket: %v, name: %v, reader: %v, opts: %v\n", client.bucket, name, reader, opts)
-		_, err := client.PutObject(client.bucket, name, reader, -1, opts)
-		fmt.Printf("newMinioWriter goroutine 2\n")
-		if err != nil {
-			fmt.Printf("newMinioWriter goroutine 3\n")
-			reader.CloseWithError(err)
-		}
-		fmt.Printf("newMinioWriter goroutine 4\n")
-		w.errChan <- err
-		fmt.Printf("newMinioWriter goroutine 5\n")
-	}()
-	return w
+	buf := getPartBuf(client.partSize)
+	return &minioWriter{
+		ctx:      ctx,
+		client:   client,
+		name:     name,
+		uploadID: uploadID,
+		curBuf:   buf,
+		cur:      (*buf)[:0],
+		sem:      make(chan struct{}, client.concurrency),
+	}, nil
 }
 
 func (w *minioWriter) Write(p []byte) (retN int, retErr error) {
-	fmt.Printf("minioWriter.Write 1\n")
 	span, _ := tracing.AddSpanToAnyExisting(w.ctx, "/Minio.Writer/Write")
-	fmt.Printf("minioWriter.Write 2\n")
 	defer func() {
-		fmt.Printf("minioWriter.Write defer\n")
 		tracing.FinishAnySpan(span, "bytes", retN, "err", retErr)
 	}()
-	fmt.Printf("minioWriter.Write 3: %v\n", p)
-	return w.pipe.Write(p)
+	n := len(p)
+	for len(p) > 0 {
+		if len(w.cur) == cap(w.cur) {
+			if err := w.flushPart(); err != nil {
+				return n - len(p), err
+			}
+		}
+		copied := copy(w.cur[len(w.cur):cap(w.cur)], p)
+		w.cur = w.cur[:len(w.cur)+copied]
+		p = p[copied:]
+	}
+	return n, nil
+}
+
+// flushPart uploads the current part buffer in the background (bounded by
+// w.sem) and swaps in a fresh buffer for subsequent writes.
+func (w *minioWriter) flushPart() error {
+	if err := w.loadErr(); err != nil {
+		return err
+	}
+	w.partNum++
+	partNum := w.partNum
+	buf, data := w.curBuf, w.cur
+
+	w.sem <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() { <-w.sem }()
+		defer putPartBuf(w.client.partSize, buf)
+
+		log.Debug(w.ctx, "uploading part", "name", w.name, "part", partNum, "bytes", len(data))
+		part, err := w.client.core.PutObjectPart(w.ctx, w.client.bucket, w.name, w.uploadID, partNum,
+			bytes.NewReader(data), int64(len(data)), "", "", nil)
+		if err != nil {
+			// Recorded, not logged here: Close is the boundary that finally
+			// handles this error, and it's the one that calls log.LogIf on it.
+			// Logging here too would double-log it, and N concurrently-failing
+			// parts from one root cause would each log separately.
+			w.setErr(err)
+			return
+		}
+		w.mu.Lock()
+		w.parts = append(w.parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+		w.mu.Unlock()
+	}()
+
+	newBuf := getPartBuf(w.client.partSize)
+	w.curBuf, w.cur = newBuf, (*newBuf)[:0]
+	return nil
+}
+
+func (w *minioWriter) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *minioWriter) loadErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
 }
 
 // This will block till upload is done
 func (w *minioWriter) Close() (retErr error) {
-	fmt.Printf("minioWriter.Close 1\n")
 	span, _ := tracing.AddSpanToAnyExisting(w.ctx, "/Minio.Writer/Close")
-	fmt.Printf("minioWriter.Close 2\n")
 	defer func() {
-		fmt.Printf("minioWriter.Close defer, err: %v\n", retErr)
+		log.LogIf(w.ctx, retErr, "name", w.name, "uploadID", w.uploadID)
 		tracing.FinishAnySpan(span, "err", retErr)
 	}()
-	fmt.Printf("minioWriter.Close 3\n")
-	if err := w.pipe.Close(); err != nil {
-		fmt.Printf("minioWriter.Close 4, err: %v\n", err)
+
+	// Flush the last (possibly partial, possibly the only) part.
+	if len(w.cur) > 0 || w.partNum == 0 {
+		if err := w.flushPart(); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	w.wg.Wait()
+	if err := w.loadErr(); err != nil {
+		w.abort()
+		return err
+	}
+
+	sort.Slice(w.parts, func(i, j int) bool { return w.parts[i].PartNumber < w.parts[j].PartNumber })
+	_, err := w.client.core.CompleteMultipartUpload(w.ctx, w.client.bucket, w.name, w.uploadID, w.parts, minio.PutObjectOptions{})
+	if err != nil {
+		w.abort()
 		return err
 	}
-	fmt.Printf("minioWriter.Close 5\n")
-	return <-w.errChan
+	return nil
 }
 
-func (c *minioClient) Writer(ctx context.Context, name string) (io.WriteCloser, error) {
-	return newMinioWriter(ctx, c, name), nil
+// abort cancels the multipart upload opened by newMinioWriter, so a failed
+// Close (or a failed part) doesn't leave it dangling on the object store
+// indefinitely. Failures aborting are logged, not returned: the caller is
+// already handling the error that triggered the abort.
+func (w *minioWriter) abort() {
+	if err := w.client.core.AbortMultipartUpload(w.ctx, w.client.bucket, w.name, w.uploadID); err != nil {
+		log.LogIf(w.ctx, err, "name", w.name, "uploadID", w.uploadID)
+	}
 }
 
-func (c *minioClient) Walk(_ context.Context, name string, fn func(name string) error) error {
-	recursive := true // Recursively walk by default.
+func (c *minioClient) Writer(ctx context.Context, name string) (io.WriteCloser, error) {
+	return newMinioWriter(ctx, c, name)
+}
 
-	doneCh := make(chan struct{})
-	defer close(doneCh)
-	for objInfo := range c.ListObjectsV2(c.bucket, name, recursive, doneCh) {
+func (c *minioClient) Walk(ctx context.Context, name string, fn func(name string) error) error {
+	for objInfo := range c.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{
+		Prefix:    name,
+		Recursive: true,
+	}) {
 		if objInfo.Err != nil {
 			return objInfo.Err
 		}
@@ -150,7 +288,7 @@ func (l *limitReadCloser) Read(p []byte) (retN int, retErr error) {
 }
 
 func (c *minioClient) Reader(ctx context.Context, name string, offset uint64, size uint64) (io.ReadCloser, error) {
-	obj, err := c.GetObject(c.bucket, name, minio.GetObjectOptions{})
+	obj, err := c.GetObject(ctx, c.bucket, name, minio.GetObjectOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -169,20 +307,31 @@ func (c *minioClient) Reader(ctx context.Context, name string, offset uint64, si
 	return obj, nil
 }
 
-func (c *minioClient) Delete(_ context.Context, name string) error {
-	return c.RemoveObject(c.bucket, name)
+func (c *minioClient) Delete(ctx context.Context, name string) error {
+	return c.RemoveObject(ctx, c.bucket, name, minio.RemoveObjectOptions{})
 }
 
 func (c *minioClient) Exists(ctx context.Context, name string) bool {
-	_, err := c.StatObject(c.bucket, name, minio.StatObjectOptions{})
+	_, err := c.StatObject(ctx, c.bucket, name, minio.StatObjectOptions{})
 	tracing.TagAnySpan(ctx, "err", err)
 	return err == nil
 }
 
+// IsRetryable reports whether err looks transient: a 5xx or a server code
+// that means "try again", or an error that isn't even a structured minio
+// ErrorResponse (e.g. a network failure dialing/reading from the server).
+// transfer.Manager relies on this to decide whether to back off and retry a
+// transfer or give up immediately.
 func (c *minioClient) IsRetryable(err error) bool {
-	// Minio client already implements retrying, no
-	// need for a caller retry.
-	return false
+	errResp := minio.ToErrorResponse(err)
+	if errResp.Code == sentinelErrResp.Code {
+		return true
+	}
+	switch errResp.Code {
+	case "InternalError", "ServiceUnavailable", "SlowDown", "RequestTimeout":
+		return true
+	}
+	return errResp.StatusCode >= 500
 }
 
 func (c *minioClient) IsIgnorable(err error) bool {
@@ -0,0 +1,159 @@
+// Package transfer provides a concurrency-bounded transfer manager used by
+// the worker to move blocks between pachd/object storage and the local
+// filesystem. It plays the same role for downloads and uploads that Docker's
+// download/upload managers play for image layers: callers submit Transfer
+// descriptors instead of doing I/O directly, which gets them deduplication,
+// retries and cancellation for free.
+package transfer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"golang.org/x/net/context"
+
+	"github.com/pachyderm/pachyderm/src/server/pkg/obj"
+)
+
+// ProgressFunc is called as bytes move for a given transfer key, so that
+// callers can report per-datum bytes-in-flight.
+type ProgressFunc func(key string, bytesDelta int64)
+
+// Transfer describes a unit of work to be scheduled by a Manager. Key
+// identifies the transfer for deduplication purposes (typically a block
+// hash or an input datum key); two Transfers submitted with the same Key
+// share a single execution of Do. Do is called with a context that is
+// cancelled only once every waiter attached to the transfer has cancelled.
+type Transfer struct {
+	Key string
+	Do  func(ctx context.Context, progress ProgressFunc) error
+}
+
+// Future is returned by Manager.Submit. It resolves once the transfer
+// backing it (shared across every waiter with the same Key) has completed.
+type Future struct {
+	done chan struct{}
+	err  error
+}
+
+// Wait blocks until the transfer completes, or ctx is cancelled. Cancelling
+// ctx only detaches this waiter; the underlying transfer keeps running for
+// any other attached waiters.
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// transfer tracks the state shared by every waiter attached to the same Key.
+type transfer struct {
+	future  *Future
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	waiters int
+}
+
+// Manager schedules Transfers onto a bounded worker pool. Transfers that
+// share a Key are deduplicated: the second and subsequent callers attach to
+// the first caller's in-flight transfer instead of starting a new one.
+type Manager struct {
+	sem chan struct{}
+
+	client   obj.Client
+	progress ProgressFunc
+
+	mu       sync.Mutex
+	inFlight map[string]*transfer
+}
+
+// NewManager returns a Manager that runs up to poolSize transfers
+// concurrently against client, classifying retryable errors with
+// client.IsRetryable. progress may be nil.
+func NewManager(client obj.Client, poolSize int, progress ProgressFunc) *Manager {
+	if progress == nil {
+		progress = func(string, int64) {}
+	}
+	return &Manager{
+		sem:      make(chan struct{}, poolSize),
+		client:   client,
+		progress: progress,
+		inFlight: make(map[string]*transfer),
+	}
+}
+
+// Submit schedules t, or attaches to an already-running transfer with the
+// same Key. It returns a Future that resolves when the transfer completes.
+func (m *Manager) Submit(ctx context.Context, t Transfer) *Future {
+	m.mu.Lock()
+	if tr, ok := m.inFlight[t.Key]; ok {
+		tr.attach()
+		m.mu.Unlock()
+		go m.detach(ctx, t.Key, tr)
+		return tr.future
+	}
+	transferCtx, cancel := context.WithCancel(context.Background())
+	tr := &transfer{
+		future: &Future{done: make(chan struct{})},
+		cancel: cancel,
+	}
+	tr.attach()
+	m.inFlight[t.Key] = tr
+	m.mu.Unlock()
+
+	go m.detach(ctx, t.Key, tr)
+	go m.run(transferCtx, t, tr)
+	return tr.future
+}
+
+// attach registers another waiter on tr.
+func (tr *transfer) attach() {
+	tr.mu.Lock()
+	tr.waiters++
+	tr.mu.Unlock()
+}
+
+// detach waits until either ctx is cancelled or the transfer finishes; on
+// cancellation it removes a waiter from tr. The transfer is only cancelled
+// once its last waiter detaches.
+func (m *Manager) detach(ctx context.Context, key string, tr *transfer) {
+	select {
+	case <-tr.future.done:
+		return
+	case <-ctx.Done():
+	}
+	tr.mu.Lock()
+	tr.waiters--
+	last := tr.waiters == 0
+	tr.mu.Unlock()
+	if last {
+		tr.cancel()
+	}
+}
+
+// run executes t on the worker pool, retrying transient errors with
+// exponential backoff, and resolves tr.future when it's done.
+func (m *Manager) run(ctx context.Context, t Transfer, tr *transfer) {
+	m.sem <- struct{}{}
+	defer func() { <-m.sem }()
+	defer func() {
+		m.mu.Lock()
+		delete(m.inFlight, t.Key)
+		m.mu.Unlock()
+		close(tr.future.done)
+	}()
+
+	var progress ProgressFunc = func(_ string, delta int64) { m.progress(t.Key, delta) }
+	tr.future.err = backoff.RetryNotify(func() error {
+		err := t.Do(ctx, progress)
+		if err != nil && (ctx.Err() != nil || !m.client.IsRetryable(err)) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.NewExponentialBackOff(), func(err error, d time.Duration) {
+		// Transient object-store error; back off and try again.
+	})
+}
@@ -2,7 +2,6 @@ package worker
 
 import (
 	"bytes"
-	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,45 +12,158 @@ import (
 
 	"go.pedge.io/proto/rpclog"
 	"golang.org/x/net/context"
-	"golang.org/x/sync/errgroup"
 
 	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/pachyderm/pachyderm/src/client"
 	"github.com/pachyderm/pachyderm/src/client/pfs"
 	"github.com/pachyderm/pachyderm/src/client/pps"
 	"github.com/pachyderm/pachyderm/src/server/pkg/hashtree"
+	"github.com/pachyderm/pachyderm/src/server/pkg/log"
 	filesync "github.com/pachyderm/pachyderm/src/server/pkg/sync"
+	"github.com/pachyderm/pachyderm/src/server/pkg/transfer"
 	ppsserver "github.com/pachyderm/pachyderm/src/server/pps"
 )
 
+// downloadPoolSize bounds how many blocks a worker will pull concurrently
+// for a single pipeline.
+const downloadPoolSize = 10
+
+// uploadPoolSize bounds how many files a worker will push to the object
+// store concurrently for a single pipeline, replacing the previous
+// unbounded errgroup fan-out in uploadOutput.
+const uploadPoolSize = 10
+
 type APIServer struct {
-	sync.Mutex
 	protorpclog.Logger
 	pachClient   *client.APIClient
 	etcdClient   *etcd.Client
 	pipelineInfo *pps.PipelineInfo
+	downloads    *transfer.Manager
+	uploads      *transfer.Manager
+	activity     *nodeActivity
+
+	// outputMu is the critical section Process used to hold for its entire
+	// body. It now only needs to guard runUserCode, stageOutput and
+	// finishUpload, since all three read or write the shared /pfs/out
+	// directory (the uploads finishUpload waits for open their files there),
+	// and must be held across all three without a gap -- releasing it in
+	// between would let a second Process call's runUserCode overwrite
+	// /pfs/out before this job's uploads have read it. Downloading goes
+	// through a.downloads, which has its own per-transfer coordination, so
+	// several Process calls can still download concurrently.
+	outputMu sync.Mutex
+
+	pullersMu sync.Mutex
+	pullers   map[string]*sharedPullerState
 }
 
 func NewAPIServer(pachClient *client.APIClient, etcdClient *etcd.Client, pipelineInfo *pps.PipelineInfo) *APIServer {
-	return &APIServer{
-		Mutex:        sync.Mutex{},
+	a := &APIServer{
 		Logger:       protorpclog.NewLogger(""),
 		pachClient:   pachClient,
 		etcdClient:   etcdClient,
 		pipelineInfo: pipelineInfo,
+		activity:     newNodeActivity(),
+		pullers:      make(map[string]*sharedPullerState),
 	}
+	a.downloads = transfer.NewManager(pachClient.ObjClient(), downloadPoolSize, a.logTransferProgress)
+	a.uploads = transfer.NewManager(pachClient.ObjClient(), uploadPoolSize, a.logTransferProgress)
+	return a
+}
+
+// pullerFor returns the sharedPullerState for key, creating one the first
+// time a caller asks for it so that concurrent Process calls pulling the
+// same datum share one set of block/byte counters.
+func (a *APIServer) pullerFor(key string, blocks []string) *sharedPullerState {
+	a.pullersMu.Lock()
+	defer a.pullersMu.Unlock()
+	if p, ok := a.pullers[key]; ok {
+		return p
+	}
+	p := newSharedPullerState(blocks)
+	a.pullers[key] = p
+	return p
+}
+
+// releasePuller discards the sharedPullerState for key once its pull has
+// completed, so a.pullers doesn't grow without bound over the worker's
+// lifetime.
+func (a *APIServer) releasePuller(key string) {
+	a.pullersMu.Lock()
+	defer a.pullersMu.Unlock()
+	delete(a.pullers, key)
 }
 
+// downloadData submits one Transfer per input datum to a.downloads and
+// waits for all of them, so that concurrent Process calls pulling the same
+// file into the same input (see pullKey) dedup onto a single pull instead
+// of fetching it once per call.
 func (a *APIServer) downloadData(ctx context.Context, data []*pfs.FileInfo) error {
+	futures := make([]*transfer.Future, len(data))
 	for i, datum := range data {
 		input := a.pipelineInfo.Inputs[i]
-		if err := filesync.Pull(ctx, a.pachClient, filepath.Join(client.PPSInputPrefix, input.Name), datum, input.Lazy); err != nil {
+		datum := datum
+		key := pullKey(input.Name, datum)
+		puller := a.pullerFor(key, datum.Objects)
+		// filesync.Pull fetches every object for this datum in one call, so
+		// there's no per-object byte count to report; split the datum's known
+		// total evenly across its objects as an approximation.
+		bytesPerObject := int64(0)
+		if n := len(datum.Objects); n > 0 {
+			bytesPerObject = datum.SizeBytes / int64(n)
+		}
+		futures[i] = a.downloads.Submit(ctx, transfer.Transfer{
+			Key: key,
+			Do: func(ctx context.Context, _ transfer.ProgressFunc) error {
+				// a.downloads dedups concurrent callers onto the one in-flight
+				// transfer for key, but it re-runs Do on each retry; key's puller
+				// state is retired from a.pullers when each attempt returns,
+				// while this closure keeps recording into puller.
+				defer a.releasePuller(key)
+
+				// The picked endpoint is used only for activity accounting:
+				// filesync.Pull takes no endpoint, so the fetch goes wherever
+				// a.pachClient sends it.
+				endpoint := a.activity.pick(a.pachClient.ObjectEndpoints())
+				a.activity.begin(endpoint)
+				err := filesync.Pull(ctx, a.pachClient, filepath.Join(client.PPSInputPrefix, input.Name), datum, input.Lazy)
+				a.activity.end(endpoint, err)
+				if err != nil {
+					puller.fail(err)
+					return err
+				}
+				for _, object := range datum.Objects {
+					puller.blockFetched(object, bytesPerObject)
+				}
+				log.Debug(ctx, "pull complete", "key", key, "bytesPulled", puller.BytesPulled(), "outstanding", len(puller.Outstanding()))
+				return nil
+			},
+		})
+	}
+	for _, f := range futures {
+		if err := f.Wait(ctx); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// pullKey identifies a pull by the input it's destined for and the datum
+// being pulled, so two datums that reference the same underlying file
+// attach to the same in-flight transfer.
+func pullKey(inputName string, datum *pfs.FileInfo) string {
+	return inputName + "/" + datum.File.Path + "@" + datum.Hash
+}
+
+// logTransferProgress is the transfer.ProgressFunc passed to a.downloads and
+// a.uploads; it logs per-datum bytes-in-flight. ProgressFunc carries no
+// context, so this goes through pkg/log with context.Background() rather
+// than a.Logger (whose Log method expects proto.Message request/response
+// values, not a transfer key).
+func (a *APIServer) logTransferProgress(key string, bytesDelta int64) {
+	log.Debug(context.Background(), "transfer progress", "key", key, "bytesDelta", bytesDelta)
+}
+
 func (a *APIServer) runUserCode(ctx context.Context) error {
 	// Create output directory (currently /pfs/out)
 	if err := os.MkdirAll(client.PPSOutputPath, 0666); err != nil {
@@ -79,76 +191,94 @@ func (a *APIServer) runUserCode(ctx context.Context) error {
 			}
 		}
 		if !success {
-			fmt.Fprintf(os.Stderr, "error from exec: %s\n", err.Error())
+			log.LogIf(ctx, err, "cmd", strings.Join(t.Cmd, " "))
 		}
 	}
 	return nil
 }
 
-func (a *APIServer) uploadOutput(ctx context.Context, tag string) error {
+// stageOutput walks /pfs/out and submits one Transfer per file to
+// a.uploads, recording each one's eventual block ref into tree. It must be
+// called with outputMu held, since it reads the same directory runUserCode
+// just wrote; the transfers themselves run through a.uploads, which bounds
+// them and applies backpressure instead of the unbounded fan-out this used
+// to do with an errgroup.
+func (a *APIServer) stageOutput(ctx context.Context, tag string, tree hashtree.HashTree) ([]*transfer.Future, error) {
 	// hashtree is not thread-safe--guard with 'lock'
 	var lock sync.Mutex
-	tree := hashtree.NewHashTree()
-
-	// Upload all files in output directory
-	var g errgroup.Group
-	if err := filepath.Walk(client.PPSOutputPath, func(path string, info os.FileInfo, err error) error {
-		g.Go(func() (retErr error) {
-			// Don't upload root directory
-			if path == client.PPSOutputPath {
-				return nil
-			}
+	var futures []*transfer.Future
+	err := filepath.Walk(client.PPSOutputPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Don't upload root directory
+		if path == client.PPSOutputPath {
+			return nil
+		}
 
-			// Get 'path' relative to /pfs/out (so we don't put /pfs/out/xyz into
-			// the object store)
-			relPath, err := filepath.Rel(client.PPSOutputPath, path)
-			if err != nil {
-				return err
-			}
+		// Get 'path' relative to /pfs/out (so we don't put /pfs/out/xyz into
+		// the object store)
+		relPath, err := filepath.Rel(client.PPSOutputPath, path)
+		if err != nil {
+			return err
+		}
 
-			// Put directory. Even if the directory is empty, that may be useful to
-			// users
-			// TODO(msteffen) write a test pipeline that outputs an empty directory and
-			// make sure it's preserved
-			if info.IsDir() {
-				lock.Lock()
-				defer lock.Unlock()
-				tree.PutDir(relPath)
-				return nil
-			}
+		// Put directory. Even if the directory is empty, that may be useful to
+		// users
+		// TODO(msteffen) write a test pipeline that outputs an empty directory and
+		// make sure it's preserved
+		if info.IsDir() {
+			lock.Lock()
+			defer lock.Unlock()
+			tree.PutDir(relPath)
+			return nil
+		}
 
-			// 1) Open the file, and upload it to pfs with PutBlock.
-			// 2) Take the block refs returned by PutBlock and put them in 'tree'
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer func() {
-				if err := f.Close(); err != nil && retErr == nil {
-					retErr = err
+		futures = append(futures, a.uploads.Submit(ctx, transfer.Transfer{
+			Key: tag + "/" + relPath,
+			Do: func(ctx context.Context, progress transfer.ProgressFunc) (retErr error) {
+				// 1) Open the file, and upload it to pfs with PutBlock.
+				// 2) Take the block refs returned by PutBlock and put them in 'tree'
+				f, err := os.Open(path)
+				if err != nil {
+					return err
 				}
-			}()
+				defer func() {
+					if err := f.Close(); err != nil && retErr == nil {
+						retErr = err
+					}
+				}()
 
-			blockRefs, err := a.pachClient.PutBlock(pfs.Delimiter_NONE, f)
-			if err != nil {
-				return err
-			}
-			lock.Lock()
-			defer lock.Unlock()
-			return tree.PutFile(relPath, blockRefs.BlockRef)
-		})
+				blockRefs, err := a.pachClient.PutBlock(pfs.Delimiter_NONE, f)
+				if err != nil {
+					return err
+				}
+				progress(relPath, info.Size())
+				lock.Lock()
+				defer lock.Unlock()
+				return tree.PutFile(relPath, blockRefs.BlockRef)
+			},
+		}))
 		return nil
-	}); err != nil {
-		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return futures, nil
+}
 
-	if err := g.Wait(); err != nil {
-		return err
+// finishUpload waits for every Transfer stageOutput submitted, then
+// serializes tree and tags it with hash(inputs + transform) so this job's
+// output can be skipped in a future job that shares the same inputs. It
+// must be called with outputMu held: the transfers it waits for open their
+// files under /pfs/out as they run.
+func (a *APIServer) finishUpload(ctx context.Context, tag string, tree hashtree.HashTree, futures []*transfer.Future) error {
+	for _, f := range futures {
+		if err := f.Wait(ctx); err != nil {
+			return err
+		}
 	}
 
-	// 3) Put 'tree' into object store; tag it with hash(inputs + transform)
-	// This way we can skip these inputs in the next job (just fetch the blocks
-	// that were output from this run)
 	finTree, err := tree.Finish()
 	if err != nil {
 		return err
@@ -167,12 +297,13 @@ func (a *APIServer) uploadOutput(ctx context.Context, tag string) error {
 }
 
 func (a *APIServer) Process(ctx context.Context, req *ProcessRequest) (resp *ProcessResponse, retErr error) {
-	defer func(start time.Time) { a.Log(req, resp, retErr, time.Since(start)) }(time.Now())
-	// We cannot run more than one user process at once; otherwise they'd be
-	// writing to the same output directory. Acquire lock to make sure only one
-	// user process runs at a time.
-	a.Lock()
-	defer a.Unlock()
+	// retErr is logged exactly once here, at the boundary where Process
+	// finally handles it, rather than at every point downstream where it's
+	// wrapped and returned.
+	defer func(start time.Time) {
+		log.LogIf(ctx, retErr, "pipeline", a.pipelineInfo.Pipeline.Name)
+		a.Log(req, resp, retErr, time.Since(start))
+	}(time.Now())
 
 	// ppsserver sorts inputs by input name, so this is stable even if
 	// a.pipelineInfo.Inputs are reordered by the user
@@ -188,13 +319,31 @@ func (a *APIServer) Process(ctx context.Context, req *ProcessRequest) (resp *Pro
 		}, nil
 	}
 
+	// Downloading is safe to run concurrently across Process calls: a.downloads
+	// dedups and bounds it on its own, and each datum writes to its own input
+	// directory.
 	if err := a.downloadData(ctx, req.Data); err != nil {
 		return nil, err
 	}
-	if err := a.runUserCode(ctx); err != nil {
-		return nil, err
-	}
-	if err := a.uploadOutput(ctx, tag); err != nil {
+
+	// runUserCode writes the shared /pfs/out directory, stageOutput walks it,
+	// and the uploads finishUpload waits for read the files in it, so all
+	// three run under one acquisition of outputMu -- releasing it before the
+	// uploads finish would let a second Process call's runUserCode overwrite
+	// /pfs/out while this job's uploads are still reading it.
+	tree := hashtree.NewHashTree()
+	if err := func() error {
+		a.outputMu.Lock()
+		defer a.outputMu.Unlock()
+		if err := a.runUserCode(ctx); err != nil {
+			return err
+		}
+		futures, err := a.stageOutput(ctx, tag, tree)
+		if err != nil {
+			return err
+		}
+		return a.finishUpload(ctx, tag, tree, futures)
+	}(); err != nil {
 		return nil, err
 	}
 	return &ProcessResponse{
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"sync"
+	"time"
+)
+
+// errorWindow is how far back nodeActivity looks when scoring an endpoint's
+// recent failures; errors older than this decay out of the score.
+const errorWindow = 30 * time.Second
+
+// nodeActivity records in-flight request counts and recent error rates for
+// the pachd/object-store endpoints available to a worker, so the puller can
+// pick the least-loaded healthy source for each block fetch instead of
+// hammering a single replica.
+type nodeActivity struct {
+	mu sync.Mutex
+
+	inFlight map[string]int
+	errors   map[string][]time.Time
+}
+
+func newNodeActivity() *nodeActivity {
+	return &nodeActivity{
+		inFlight: make(map[string]int),
+		errors:   make(map[string][]time.Time),
+	}
+}
+
+// begin records that a request to endpoint has started.
+func (n *nodeActivity) begin(endpoint string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inFlight[endpoint]++
+}
+
+// end records that a request to endpoint has finished, successfully or not.
+func (n *nodeActivity) end(endpoint string, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inFlight[endpoint]--
+	if err != nil {
+		n.errors[endpoint] = append(n.errors[endpoint], time.Now())
+	}
+}
+
+// pick returns the endpoint among candidates with the lowest score, per
+// score. If candidates is empty (no reachable endpoints, e.g. during a
+// rolling restart), it returns "" rather than panicking; begin/end then
+// just track activity under that placeholder key.
+func (n *nodeActivity) pick(candidates []string) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	best := candidates[0]
+	bestScore := n.score(best)
+	for _, candidate := range candidates[1:] {
+		if score := n.score(candidate); score < bestScore {
+			best = candidate
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// score ranks an endpoint by its in-flight request count, heavily
+// penalizing endpoints with errors inside errorWindow so the puller
+// deprioritizes them without ruling them out entirely once they recover.
+// Callers must hold n.mu.
+func (n *nodeActivity) score(endpoint string) int {
+	cutoff := time.Now().Add(-errorWindow)
+	recentErrors := 0
+	live := n.errors[endpoint][:0]
+	for _, t := range n.errors[endpoint] {
+		if t.After(cutoff) {
+			recentErrors++
+			live = append(live, t)
+		}
+	}
+	n.errors[endpoint] = live
+	return n.inFlight[endpoint] + recentErrors*10
+}
@@ -0,0 +1,76 @@
+package worker
+
+import "sync"
+
+// sharedPullerState tracks the progress of pulling the blocks that back a
+// single (pipeline, datum) pair: which blocks have been fetched, which are
+// still outstanding, how many bytes have moved, and the first terminal
+// error encountered. It's guarded by its own mutex, so pulls for different
+// datums never contend with each other the way a single APIServer-wide lock
+// would force them to.
+type sharedPullerState struct {
+	mu sync.Mutex
+
+	fetched     map[string]bool
+	outstanding map[string]bool
+	bytesPulled int64
+	err         error
+}
+
+// newSharedPullerState returns a sharedPullerState with every block in
+// blocks marked outstanding.
+func newSharedPullerState(blocks []string) *sharedPullerState {
+	outstanding := make(map[string]bool, len(blocks))
+	for _, block := range blocks {
+		outstanding[block] = true
+	}
+	return &sharedPullerState{
+		fetched:     make(map[string]bool, len(blocks)),
+		outstanding: outstanding,
+	}
+}
+
+// blockFetched records that block has been pulled, moving it from
+// outstanding to fetched and adding n to the byte counter.
+func (s *sharedPullerState) blockFetched(block string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.outstanding, block)
+	s.fetched[block] = true
+	s.bytesPulled += n
+}
+
+// fail records err as the terminal error for this pull, if one hasn't
+// already been recorded.
+func (s *sharedPullerState) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first terminal error recorded by fail, if any.
+func (s *sharedPullerState) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Outstanding returns the blocks that have not yet been fetched.
+func (s *sharedPullerState) Outstanding() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	outstanding := make([]string, 0, len(s.outstanding))
+	for block := range s.outstanding {
+		outstanding = append(outstanding, block)
+	}
+	return outstanding
+}
+
+// BytesPulled returns the number of bytes fetched so far.
+func (s *sharedPullerState) BytesPulled() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytesPulled
+}